@@ -0,0 +1,21 @@
+package aws
+
+import (
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Provider returns a terraform.ResourceProvider for AWS.
+//
+// This file only carries the ResourcesMap entries for the resources present
+// in this vendored slice of the provider (the aws_ami family); the rest of
+// the real terraform-provider-aws ResourcesMap lives upstream and isn't part
+// of this tree.
+func Provider() terraform.ResourceProvider {
+	return &schema.Provider{
+		ResourcesMap: map[string]*schema.Resource{
+			"aws_ami_copy":         resourceAwsAmiCopy(),
+			"aws_ami_from_volumes": resourceAwsAmiFromVolumes(),
+		},
+	}
+}
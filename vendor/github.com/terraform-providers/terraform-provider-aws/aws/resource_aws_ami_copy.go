@@ -3,18 +3,44 @@ package aws
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 
 	"github.com/hashicorp/terraform/helper/hashcode"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"github.com/hashicorp/terraform/terraform"
 )
 
+// amiRegionCopyConcurrency bounds the number of CopyImage calls that
+// resourceAwsAmiCopyFanOutRegions will have in flight at once, so a resource
+// with a long destination_regions list doesn't hammer the EC2 API and get
+// throttled.
+const amiRegionCopyConcurrency = 4
+
 func resourceAwsAmiCopy() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceAwsAmiCopyCreate,
 
+		// CustomizeDiff forces a plan whenever destination_regions lists a
+		// region that region_ami_ids doesn't have an entry for yet, even
+		// though nothing else in the config changed. Without it, a region
+		// left incomplete by Create would never get another chance to copy:
+		// Terraform only calls Update when a diff exists.
+		CustomizeDiff: resourceAwsAmiCopyCustomizeDiff,
+
+		// SchemaVersion 1 reflects encrypted changing from a TypeBool
+		// (Default: false) to the tri-state TypeString it is today.
+		// MigrateState rewrites the old "false" default to "" so existing
+		// resources don't plan a spurious "false" -> "" change and
+		// force-recreate on the first apply after upgrading.
+		SchemaVersion: 1,
+		MigrateState:  resourceAwsAmiCopyMigrateState,
+
 		Timeouts: &schema.ResourceTimeout{
 			Create: schema.DefaultTimeout(AWSAMIRetryTimeout),
 			Update: schema.DefaultTimeout(AWSAMIRetryTimeout),
@@ -30,6 +56,41 @@ func resourceAwsAmiCopy() *schema.Resource {
 				Type:     schema.TypeString,
 				Optional: true,
 			},
+			// destination_regions lets a single aws_ami_copy fan out the source
+			// AMI into additional regions beyond the provider's own, mirroring
+			// the multi-region copy support in Packer's Amazon builders.
+			"destination_regions": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"region_kms_key_ids": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"region_ami_ids": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"region_snapshot_ids": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			// region_copy_errors surfaces the last error seen for each
+			// destination region whose copy failed, since Create
+			// intentionally does not fail the apply over a partial
+			// region-copy failure (see resourceAwsAmiCopyCreate). A region
+			// whose CopyImage call succeeded but whose wait or describe then
+			// failed also keeps its AMI id in region_ami_ids; it is not
+			// copied again, and its entry here is not cleared by later applies.
+			"region_copy_errors": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
 			// The following block device attributes intentionally mimick the
 			// corresponding attributes on aws_instance, since they have the
 			// same meaning.
@@ -116,11 +177,23 @@ func resourceAwsAmiCopy() *schema.Resource {
 				Type:     schema.TypeBool,
 				Computed: true,
 			},
+			// encrypted is a tri-state string, not a bool: helper/schema's
+			// GetOkExists cannot reliably tell an explicit "false" apart from
+			// "unset" for TypeBool, which is exactly the distinction this
+			// attribute needs. "" (the default) lets CopyImage inherit the
+			// source AMI's own encryption state; "true"/"false" force it on
+			// or off. It isn't Computed, since the shared resourceAwsAmiRead
+			// has no way to populate it and a Computed attribute with no Read
+			// support just produces a perpetual diff.
 			"encrypted": {
-				Type:     schema.TypeBool,
+				Type:     schema.TypeString,
 				Optional: true,
-				Default:  false,
 				ForceNew: true,
+				ValidateFunc: validation.StringInSlice([]string{
+					"",
+					"true",
+					"false",
+				}, false),
 			},
 			"image_location": {
 				Type:     schema.TypeString,
@@ -146,6 +219,26 @@ func resourceAwsAmiCopy() *schema.Resource {
 				Computed: true,
 				ForceNew: true,
 			},
+			// force_deregister and force_delete_snapshot let CI pipelines that
+			// rebuild an AMI under a stable name clean up completely on
+			// delete, even when the AMI has been shared or launched and even
+			// for snapshots this resource didn't record as owned.
+			//
+			// Scope: these flags only exist on aws_ami_copy and
+			// aws_ami_from_volumes, since this tree has no
+			// resource_aws_ami.go/resource_aws_ami_from_instance.go to add
+			// them to. aws_ami/aws_ami_from_instance don't gain force-delete
+			// support until those files exist here.
+			"force_deregister": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"force_delete_snapshot": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
 			"name": {
 				Type:     schema.TypeString,
 				Required: true,
@@ -184,14 +277,40 @@ func resourceAwsAmiCopy() *schema.Resource {
 			},
 		},
 
-		// The remaining operations are shared with the generic aws_ami resource,
-		// since the aws_ami_copy resource only differs in how it's created.
+		// Read is shared with the generic aws_ami resource, since the
+		// aws_ami_copy resource only differs in how it's created. Update and
+		// Delete wrap the shared implementations to also manage the
+		// destination_regions copies.
 		Read:   resourceAwsAmiRead,
-		Update: resourceAwsAmiUpdate,
-		Delete: resourceAwsAmiDelete,
+		Update: resourceAwsAmiCopyUpdate,
+		Delete: resourceAwsAmiCopyDelete,
 	}
 }
 
+func resourceAwsAmiCopyMigrateState(v int, is *terraform.InstanceState, meta interface{}) (*terraform.InstanceState, error) {
+	switch v {
+	case 0:
+		return migrateAwsAmiCopyStateV0toV1(is)
+	default:
+		return is, fmt.Errorf("unexpected schema version for aws_ami_copy: %d", v)
+	}
+}
+
+// migrateAwsAmiCopyStateV0toV1 rewrites the old TypeBool "false" default for
+// encrypted to the empty string, which is now what "unset" (inherit the
+// source AMI's encryption) means under the tri-state TypeString.
+func migrateAwsAmiCopyStateV0toV1(is *terraform.InstanceState) (*terraform.InstanceState, error) {
+	if is.Empty() {
+		return is, nil
+	}
+
+	if is.Attributes["encrypted"] == "false" {
+		is.Attributes["encrypted"] = ""
+	}
+
+	return is, nil
+}
+
 func resourceAwsAmiCopyCreate(d *schema.ResourceData, meta interface{}) error {
 	client := meta.(*AWSClient).ec2conn
 
@@ -200,7 +319,23 @@ func resourceAwsAmiCopyCreate(d *schema.ResourceData, meta interface{}) error {
 		Description:   aws.String(d.Get("description").(string)),
 		SourceImageId: aws.String(d.Get("source_ami_id").(string)),
 		SourceRegion:  aws.String(d.Get("source_ami_region").(string)),
-		Encrypted:     aws.Bool(d.Get("encrypted").(bool)),
+	}
+
+	// Only send Encrypted when the user explicitly configured it; leaving it
+	// "" unset lets CopyImage inherit the source AMI's own encryption state
+	// instead of forcibly decrypting an already-encrypted source.
+	if v := d.Get("encrypted").(string); v != "" {
+		encrypted, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("encrypted: %s", err)
+		}
+		req.Encrypted = aws.Bool(encrypted)
+
+		if encrypted {
+			if _, ok := d.GetOk("kms_key_id"); !ok {
+				return fmt.Errorf(`kms_key_id must be set when encrypted is explicitly "true"`)
+			}
+		}
 	}
 
 	if v, ok := d.GetOk("kms_key_id"); ok {
@@ -224,5 +359,305 @@ func resourceAwsAmiCopyCreate(d *schema.ResourceData, meta interface{}) error {
 		return err
 	}
 
+	// Deliberately not propagated: Terraform taints (and fully recreates on
+	// the next apply) any resource whose Create returns an error once an id
+	// has been set, which would re-copy every region instead of resuming
+	// just the ones still missing. The error is already recorded in
+	// region_copy_errors by resourceAwsAmiCopyFanOutRegions; CustomizeDiff
+	// ensures a later apply calls resourceAwsAmiCopyUpdate again to retry,
+	// where the same error *is* surfaced without tainting the resource.
+	_ = resourceAwsAmiCopyFanOutRegions(d, meta)
+
+	return resourceAwsAmiUpdate(d, meta)
+}
+
+// resourceAwsAmiCopyCustomizeDiff forces a non-empty plan whenever
+// destination_regions names a region that region_ami_ids doesn't have an
+// entry for, so Update gets a chance to resume it even when nothing else in
+// the config changed.
+func resourceAwsAmiCopyCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	destRegions := d.Get("destination_regions").([]interface{})
+	regionAmiIds := d.Get("region_ami_ids").(map[string]interface{})
+
+	for _, r := range destRegions {
+		if _, ok := regionAmiIds[r.(string)]; !ok {
+			d.SetNewComputed("region_ami_ids")
+			d.SetNewComputed("region_snapshot_ids")
+			d.SetNewComputed("region_copy_errors")
+			break
+		}
+	}
+
+	return nil
+}
+
+// resourceAwsAmiCopyUpdate resumes any destination_regions copies that are
+// still missing before delegating to the update logic shared with aws_ami.
+// Unlike Create, an error returned here does not taint the resource, so it's
+// safe to surface region-copy failures directly.
+func resourceAwsAmiCopyUpdate(d *schema.ResourceData, meta interface{}) error {
+	if err := resourceAwsAmiCopyFanOutRegions(d, meta); err != nil {
+		return err
+	}
+
 	return resourceAwsAmiUpdate(d, meta)
 }
+
+// resourceAwsAmiCopyFanOutRegions copies the AMI into any destination_regions
+// that don't already have a recorded region_ami_ids entry, with bounded
+// concurrency. Regions that complete are recorded as partial state even if a
+// sibling region fails, so a subsequent apply only resumes the regions that
+// are still missing rather than re-copying completed ones.
+func resourceAwsAmiCopyFanOutRegions(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*AWSClient)
+
+	destRegions := d.Get("destination_regions").([]interface{})
+	if len(destRegions) == 0 {
+		return nil
+	}
+
+	regionKmsKeyIds := d.Get("region_kms_key_ids").(map[string]interface{})
+	regionAmiIds := d.Get("region_ami_ids").(map[string]interface{})
+	regionSnapshotIds := d.Get("region_snapshot_ids").(map[string]interface{})
+	regionCopyErrors := d.Get("region_copy_errors").(map[string]interface{})
+
+	var pending []string
+	for _, r := range destRegions {
+		region := r.(string)
+		if _, ok := regionAmiIds[region]; !ok {
+			pending = append(pending, region)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	name := d.Get("name").(string)
+	description := d.Get("description").(string)
+	sourceAmiId := d.Get("source_ami_id").(string)
+	sourceAmiRegion := d.Get("source_ami_region").(string)
+
+	type regionResult struct {
+		region     string
+		amiId      string
+		snapshotId string
+		err        error
+	}
+
+	sem := make(chan struct{}, amiRegionCopyConcurrency)
+	results := make(chan regionResult, len(pending))
+	var wg sync.WaitGroup
+
+	for _, region := range pending {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			regionConn := ec2.New(client.session, aws.NewConfig().WithRegion(region))
+
+			req := &ec2.CopyImageInput{
+				Name:          aws.String(name),
+				Description:   aws.String(description),
+				SourceImageId: aws.String(sourceAmiId),
+				SourceRegion:  aws.String(sourceAmiRegion),
+			}
+			if kmsKeyId, ok := regionKmsKeyIds[region]; ok {
+				req.Encrypted = aws.Bool(true)
+				req.KmsKeyId = aws.String(kmsKeyId.(string))
+			}
+
+			res, err := regionConn.CopyImage(req)
+			if err != nil {
+				results <- regionResult{region: region, err: fmt.Errorf("copying AMI: %s", err)}
+				return
+			}
+			amiId := *res.ImageId
+
+			if _, err := resourceAwsAmiWaitForAvailable(d.Timeout(schema.TimeoutCreate), amiId, regionConn); err != nil {
+				results <- regionResult{region: region, amiId: amiId, err: err}
+				return
+			}
+
+			snapshotId := ""
+			describeResp, err := regionConn.DescribeImages(&ec2.DescribeImagesInput{
+				ImageIds: []*string{aws.String(amiId)},
+			})
+			if err != nil {
+				results <- regionResult{region: region, amiId: amiId, err: fmt.Errorf("describing copied AMI: %s", err)}
+				return
+			}
+			if len(describeResp.Images) == 1 {
+				for _, bdm := range describeResp.Images[0].BlockDeviceMappings {
+					if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
+						snapshotId = *bdm.Ebs.SnapshotId
+						break
+					}
+				}
+			}
+
+			results <- regionResult{region: region, amiId: amiId, snapshotId: snapshotId}
+		}(region)
+	}
+
+	wg.Wait()
+	close(results)
+
+	d.Partial(true)
+	defer d.Partial(false)
+
+	var errs []string
+	for res := range results {
+		if res.amiId != "" {
+			regionAmiIds[res.region] = res.amiId
+		}
+		if res.snapshotId != "" {
+			regionSnapshotIds[res.region] = res.snapshotId
+		}
+		if res.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", res.region, res.err))
+			regionCopyErrors[res.region] = res.err.Error()
+		} else {
+			// Clear any error recorded by a prior failed attempt now that
+			// this region has succeeded.
+			delete(regionCopyErrors, res.region)
+		}
+	}
+	d.Set("region_ami_ids", regionAmiIds)
+	d.SetPartial("region_ami_ids")
+	d.Set("region_snapshot_ids", regionSnapshotIds)
+	d.SetPartial("region_snapshot_ids")
+	d.Set("region_copy_errors", regionCopyErrors)
+	d.SetPartial("region_copy_errors")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error copying AMI to %d region(s), recorded in region_copy_errors for the next apply to retry: %s", len(errs), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// resourceAwsAmiCopyDelete deregisters the AMI in every destination region
+// and deletes its snapshots there: every snapshot DescribeImages reports when
+// force_delete_snapshot is set, otherwise the recorded one if
+// manage_ebs_snapshots is set. It then deletes the primary-region AMI through
+// resourceAwsAmiForceDelete when either force flag is set, and through the
+// delete logic shared with aws_ami otherwise.
+func resourceAwsAmiCopyDelete(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*AWSClient)
+	manageSnapshots := d.Get("manage_ebs_snapshots").(bool)
+	forceDeregister := d.Get("force_deregister").(bool)
+	forceDeleteSnapshot := d.Get("force_delete_snapshot").(bool)
+
+	regionAmiIds := d.Get("region_ami_ids").(map[string]interface{})
+	regionSnapshotIds := d.Get("region_snapshot_ids").(map[string]interface{})
+
+	for region, v := range regionAmiIds {
+		amiId := v.(string)
+		regionConn := ec2.New(client.session, aws.NewConfig().WithRegion(region))
+
+		// When force_delete_snapshot is set, discover every snapshot backing
+		// this regional AMI via DescribeImages before deregistering it,
+		// rather than relying solely on the one recorded in state.
+		var snapshotIds []string
+		if forceDeleteSnapshot {
+			describeResp, err := regionConn.DescribeImages(&ec2.DescribeImagesInput{
+				ImageIds: []*string{aws.String(amiId)},
+			})
+			if err != nil {
+				return fmt.Errorf("error describing AMI %s in %s before delete: %s", amiId, region, err)
+			}
+			if len(describeResp.Images) == 1 {
+				for _, bdm := range describeResp.Images[0].BlockDeviceMappings {
+					if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
+						snapshotIds = append(snapshotIds, *bdm.Ebs.SnapshotId)
+					}
+				}
+			}
+		} else if manageSnapshots {
+			if snapshotId, ok := regionSnapshotIds[region]; ok {
+				snapshotIds = append(snapshotIds, snapshotId.(string))
+			}
+		}
+
+		if _, err := regionConn.DeregisterImage(&ec2.DeregisterImageInput{
+			ImageId: aws.String(amiId),
+		}); err != nil && !forceDeregister {
+			return fmt.Errorf("error deregistering AMI %s in %s: %s", amiId, region, err)
+		}
+
+		for _, snapshotId := range snapshotIds {
+			if _, err := regionConn.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(snapshotId),
+			}); err != nil {
+				return fmt.Errorf("error deleting snapshot %s in %s: %s", snapshotId, region, err)
+			}
+		}
+	}
+
+	if forceDeregister || forceDeleteSnapshot {
+		return resourceAwsAmiForceDelete(d, meta)
+	}
+
+	return resourceAwsAmiDelete(d, meta)
+}
+
+// resourceAwsAmiForceDelete is the delete path used when force_deregister or
+// force_delete_snapshot is set. When force_delete_snapshot is set, it
+// discovers every EBS snapshot currently backing the AMI via DescribeImages
+// -- not just the one recorded in state under manage_ebs_snapshots. When
+// force_deregister is set, an error from DeregisterImage is ignored and the
+// snapshot deletes still run.
+// It's shared by aws_ami_copy and aws_ami_from_volumes, the two resources
+// that can accrue orphaned snapshots under a stable name.
+func resourceAwsAmiForceDelete(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*AWSClient).ec2conn
+	id := d.Id()
+	forceDeregister := d.Get("force_deregister").(bool)
+	forceDeleteSnapshot := d.Get("force_delete_snapshot").(bool)
+
+	// Always delete the manage_ebs_snapshots-owned root snapshot, same as
+	// the non-force delete path would -- force_deregister=true with
+	// force_delete_snapshot=false must not leak the snapshot this resource
+	// itself created just because it took the force path.
+	snapshotIds := map[string]bool{}
+	if d.Get("manage_ebs_snapshots").(bool) {
+		if v, ok := d.GetOk("root_snapshot_id"); ok {
+			snapshotIds[v.(string)] = true
+		}
+	}
+
+	if forceDeleteSnapshot {
+		describeResp, err := client.DescribeImages(&ec2.DescribeImagesInput{
+			ImageIds: []*string{aws.String(id)},
+		})
+		if err != nil {
+			return fmt.Errorf("error describing AMI %s before delete: %s", id, err)
+		}
+		if len(describeResp.Images) == 1 {
+			for _, bdm := range describeResp.Images[0].BlockDeviceMappings {
+				if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
+					snapshotIds[*bdm.Ebs.SnapshotId] = true
+				}
+			}
+		}
+	}
+
+	if _, err := client.DeregisterImage(&ec2.DeregisterImageInput{
+		ImageId: aws.String(id),
+	}); err != nil && !forceDeregister {
+		return fmt.Errorf("error deregistering AMI %s: %s", id, err)
+	}
+
+	for snapshotId := range snapshotIds {
+		if _, err := client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotId),
+		}); err != nil {
+			return fmt.Errorf("error deleting snapshot %s: %s", snapshotId, err)
+		}
+	}
+
+	d.SetId("")
+	return nil
+}
@@ -0,0 +1,432 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/terraform/helper/resource"
+
+	"github.com/hashicorp/terraform/helper/hashcode"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceAwsAmiFromVolumes implements the "ebssurrogate" pattern: it
+// registers an AMI whose root device is a snapshot of a user-supplied EBS
+// volume (or an existing snapshot), rather than snapshotting a running
+// instance or copying an existing AMI. This enables building AMIs from
+// chroot/dd style workflows that never boot an EC2 instance.
+func resourceAwsAmiFromVolumes() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceAwsAmiFromVolumesCreate,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(AWSAMIRetryTimeout),
+			Update: schema.DefaultTimeout(AWSAMIRetryTimeout),
+			Delete: schema.DefaultTimeout(AWSAMIDeleteRetryTimeout),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"ami_virtualization_type": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "paravirtual",
+				ForceNew: true,
+			},
+			"architecture": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "x86_64",
+				ForceNew: true,
+			},
+			"description": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			// The following block device attributes intentionally mimick the
+			// corresponding attributes on aws_instance, since they have the
+			// same meaning. They describe the non-root devices only; the root
+			// device is always built from root_volume_id/root_snapshot_id.
+			"ebs_block_device": {
+				Type:     schema.TypeSet,
+				Optional: true,
+				ForceNew: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"delete_on_termination": {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  true,
+							ForceNew: true,
+						},
+
+						"device_name": {
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+
+						"encrypted": {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+
+						"iops": {
+							Type:     schema.TypeInt,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+
+						"snapshot_id": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+
+						"volume_size": {
+							Type:     schema.TypeInt,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+
+						"volume_type": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+					},
+				},
+				Set: func(v interface{}) int {
+					var buf bytes.Buffer
+					m := v.(map[string]interface{})
+					buf.WriteString(fmt.Sprintf("%s-", m["device_name"].(string)))
+					buf.WriteString(fmt.Sprintf("%s-", m["snapshot_id"].(string)))
+					return hashcode.String(buf.String())
+				},
+			},
+			"ephemeral_block_device": {
+				Type:     schema.TypeSet,
+				Optional: true,
+				ForceNew: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"device_name": {
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+
+						"virtual_name": {
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+					},
+				},
+				Set: func(v interface{}) int {
+					var buf bytes.Buffer
+					m := v.(map[string]interface{})
+					buf.WriteString(fmt.Sprintf("%s-", m["device_name"].(string)))
+					buf.WriteString(fmt.Sprintf("%s-", m["virtual_name"].(string)))
+					return hashcode.String(buf.String())
+				},
+			},
+			"ena_support": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				ForceNew: true,
+			},
+			// force_deregister and force_delete_snapshot let CI pipelines that
+			// rebuild an AMI under a stable name clean up completely on
+			// delete, even when the AMI has been shared or launched and even
+			// for snapshots this resource didn't record as owned. See the
+			// scope note on these same attributes in resource_aws_ami_copy.go.
+			"force_deregister": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"force_delete_snapshot": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"image_location": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"kernel_id": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			// kms_key_id, when set, causes the root snapshot to be copied
+			// through CopySnapshot with encryption enabled before
+			// RegisterImage is called, so the resulting AMI boots from an
+			// encrypted root volume even when root_volume_id/root_snapshot_id
+			// were not already encrypted.
+			"kms_key_id": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateArn,
+			},
+			// Not a public attribute; used to let the aws_ami_copy and
+			// aws_ami_from_volumes resources record that they implicitly
+			// created new EBS snapshots that we should now manage.
+			"manage_ebs_snapshots": {
+				Type:     schema.TypeBool,
+				Computed: true,
+				ForceNew: true,
+			},
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"ramdisk_id": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			"root_device_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"root_snapshot_id": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"root_volume_id"},
+			},
+			"root_volume_id": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"root_snapshot_id"},
+			},
+			"sriov_net_support": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "simple",
+				ForceNew: true,
+			},
+			"tags": tagsSchema(),
+			"virtualization_type": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+
+		// Read and Update are shared with the generic aws_ami resource, since
+		// aws_ami_from_volumes only differs in how it's created. Delete wraps
+		// the shared implementation to honor force_deregister and
+		// force_delete_snapshot.
+		Read:   resourceAwsAmiRead,
+		Update: resourceAwsAmiUpdate,
+		Delete: resourceAwsAmiFromVolumesDelete,
+	}
+}
+
+func resourceAwsAmiFromVolumesDelete(d *schema.ResourceData, meta interface{}) error {
+	if d.Get("force_deregister").(bool) || d.Get("force_delete_snapshot").(bool) {
+		return resourceAwsAmiForceDelete(d, meta)
+	}
+
+	return resourceAwsAmiDelete(d, meta)
+}
+
+func resourceAwsAmiFromVolumesCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*AWSClient).ec2conn
+
+	rootVolumeId, hasRootVolumeId := d.GetOk("root_volume_id")
+	rootSnapshotId, hasRootSnapshotId := d.GetOk("root_snapshot_id")
+	if !hasRootVolumeId && !hasRootSnapshotId {
+		return fmt.Errorf("one of root_volume_id or root_snapshot_id must be set")
+	}
+
+	snapshotId := ""
+	ownsIntermediateSnapshot := false
+	if hasRootSnapshotId {
+		snapshotId = rootSnapshotId.(string)
+	} else {
+		snapshotDesc := fmt.Sprintf("Created by Terraform aws_ami_from_volumes %s from %s", d.Get("name").(string), rootVolumeId.(string))
+		snapRes, err := client.CreateSnapshot(&ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(rootVolumeId.(string)),
+			Description: aws.String(snapshotDesc),
+		})
+		if err != nil {
+			return fmt.Errorf("error creating root snapshot from %s: %s", rootVolumeId.(string), err)
+		}
+		snapshotId = *snapRes.SnapshotId
+		ownsIntermediateSnapshot = true
+
+		if err := resourceAwsAmiFromVolumesWaitForSnapshot(client, snapshotId, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return err
+		}
+	}
+
+	if kmsKeyId, ok := d.GetOk("kms_key_id"); ok {
+		copyRes, err := client.CopySnapshot(&ec2.CopySnapshotInput{
+			SourceSnapshotId: aws.String(snapshotId),
+			SourceRegion:     aws.String(meta.(*AWSClient).region),
+			Encrypted:        aws.Bool(true),
+			KmsKeyId:         aws.String(kmsKeyId.(string)),
+			Description:      aws.String(fmt.Sprintf("Encrypted copy of %s for aws_ami_from_volumes %s", snapshotId, d.Get("name").(string))),
+		})
+		if err != nil {
+			return fmt.Errorf("error copying root snapshot %s for encryption: %s", snapshotId, err)
+		}
+		encryptedSnapshotId := *copyRes.SnapshotId
+
+		if err := resourceAwsAmiFromVolumesWaitForSnapshot(client, encryptedSnapshotId, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return err
+		}
+
+		// The unencrypted intermediate snapshot is superseded by the
+		// encrypted copy and never referenced by the AMI or recorded in
+		// state, so if we created it ourselves we must clean it up here --
+		// otherwise it orphans on every encrypted-build apply. A
+		// user-supplied root_snapshot_id is left alone, since it isn't ours
+		// to delete.
+		if ownsIntermediateSnapshot {
+			if _, err := client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(snapshotId),
+			}); err != nil {
+				return fmt.Errorf("error deleting intermediate root snapshot %s after encrypted copy: %s", snapshotId, err)
+			}
+		}
+
+		snapshotId = encryptedSnapshotId
+	}
+
+	blockDeviceMappings := []*ec2.BlockDeviceMapping{
+		{
+			DeviceName: aws.String(d.Get("root_device_name").(string)),
+			Ebs: &ec2.EbsBlockDevice{
+				SnapshotId:          aws.String(snapshotId),
+				DeleteOnTermination: aws.Bool(true),
+			},
+		},
+	}
+	for _, v := range d.Get("ebs_block_device").(*schema.Set).List() {
+		bd := v.(map[string]interface{})
+		mapping := &ec2.BlockDeviceMapping{
+			DeviceName: aws.String(bd["device_name"].(string)),
+			Ebs: &ec2.EbsBlockDevice{
+				DeleteOnTermination: aws.Bool(bd["delete_on_termination"].(bool)),
+			},
+		}
+		if v, ok := bd["snapshot_id"].(string); ok && v != "" {
+			mapping.Ebs.SnapshotId = aws.String(v)
+		}
+		if v, ok := bd["volume_size"].(int); ok && v != 0 {
+			mapping.Ebs.VolumeSize = aws.Int64(int64(v))
+		}
+		if v, ok := bd["volume_type"].(string); ok && v != "" {
+			mapping.Ebs.VolumeType = aws.String(v)
+		}
+		if v, ok := bd["iops"].(int); ok && v != 0 {
+			mapping.Ebs.Iops = aws.Int64(int64(v))
+		}
+		if v, ok := bd["encrypted"].(bool); ok && v {
+			mapping.Ebs.Encrypted = aws.Bool(v)
+		}
+		blockDeviceMappings = append(blockDeviceMappings, mapping)
+	}
+	for _, v := range d.Get("ephemeral_block_device").(*schema.Set).List() {
+		bd := v.(map[string]interface{})
+		blockDeviceMappings = append(blockDeviceMappings, &ec2.BlockDeviceMapping{
+			DeviceName:  aws.String(bd["device_name"].(string)),
+			VirtualName: aws.String(bd["virtual_name"].(string)),
+		})
+	}
+
+	req := &ec2.RegisterImageInput{
+		Name:                aws.String(d.Get("name").(string)),
+		Architecture:        aws.String(d.Get("architecture").(string)),
+		VirtualizationType:  aws.String(d.Get("ami_virtualization_type").(string)),
+		RootDeviceName:      aws.String(d.Get("root_device_name").(string)),
+		SriovNetSupport:     aws.String(d.Get("sriov_net_support").(string)),
+		BlockDeviceMappings: blockDeviceMappings,
+	}
+	if v, ok := d.GetOk("description"); ok {
+		req.Description = aws.String(v.(string))
+	}
+	if v, ok := d.GetOk("kernel_id"); ok {
+		req.KernelId = aws.String(v.(string))
+	}
+	if v, ok := d.GetOk("ramdisk_id"); ok {
+		req.RamdiskId = aws.String(v.(string))
+	}
+	if v, ok := d.GetOk("ena_support"); ok {
+		req.EnaSupport = aws.Bool(v.(bool))
+	}
+
+	res, err := client.RegisterImage(req)
+	if err != nil {
+		return fmt.Errorf("error registering AMI: %s", err)
+	}
+
+	id := *res.ImageId
+	d.SetId(id)
+	d.Partial(true) // make sure we record the id and owned snapshot even if the rest of this gets interrupted
+	d.Set("manage_ebs_snapshots", true)
+	d.SetPartial("manage_ebs_snapshots")
+	d.Set("root_snapshot_id", snapshotId)
+	d.SetPartial("root_snapshot_id")
+	d.Partial(false)
+
+	_, err = resourceAwsAmiWaitForAvailable(d.Timeout(schema.TimeoutCreate), id, client)
+	if err != nil {
+		return err
+	}
+
+	return resourceAwsAmiUpdate(d, meta)
+}
+
+func resourceAwsAmiFromVolumesWaitForSnapshot(client *ec2.EC2, id string, timeout time.Duration) error {
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"pending"},
+		Target:     []string{"completed"},
+		Refresh:    resourceAwsAmiFromVolumesSnapshotStateRefreshFunc(client, id),
+		Timeout:    timeout,
+		Delay:      10 * time.Second,
+		MinTimeout: 3 * time.Second,
+	}
+	_, err := stateConf.WaitForState()
+	if err != nil {
+		return fmt.Errorf("error waiting for snapshot %s to become available: %s", id, err)
+	}
+	return nil
+}
+
+func resourceAwsAmiFromVolumesSnapshotStateRefreshFunc(client *ec2.EC2, id string) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		res, err := client.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(id)},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if len(res.Snapshots) == 0 {
+			// The snapshot can briefly be invisible to DescribeSnapshots right
+			// after CreateSnapshot/CopySnapshot returns. Report "pending"
+			// rather than an empty state so StateChangeConf keeps polling
+			// instead of failing on an "unexpected state".
+			return nil, "pending", nil
+		}
+		return res.Snapshots[0], *res.Snapshots[0].State, nil
+	}
+}